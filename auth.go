@@ -0,0 +1,135 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/gorilla/websocket"
+)
+
+// Коды закрытия WebSocket-соединения для ошибок аутентификации.
+// 4000-4999 - приватный диапазон, см. RFC 6455 7.4.2.
+const (
+	closeInvalidToken = 4001 // токен отсутствует, битый или истёк
+	closeForbidden    = 4003 // токен валиден, но не даёт прав на это действие
+	authRecheckPeriod = 30 * time.Second
+)
+
+var errMissingToken = errors.New("missing token")
+
+type claimsContextKey struct{}
+
+func withClaims(r *http.Request, claims *Claims) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), claimsContextKey{}, claims))
+}
+
+func claimsFromContext(r *http.Request) *Claims {
+	claims, _ := r.Context().Value(claimsContextKey{}).(*Claims)
+	return claims
+}
+
+// Claims - полезная нагрузка JWT, который клиенты предъявляют на /ws и /send
+type Claims struct {
+	Rooms      []string `json:"rooms,omitempty"`       // комнаты, в которые можно вступать/публиковать
+	CanPublish bool     `json:"can_publish,omitempty"` // разрешение на /send и публикацию сообщений
+	Roles      []string `json:"roles,omitempty"`
+	jwt.RegisteredClaims
+}
+
+// allowsRoom проверяет, входит ли комната в список разрешённых для токена.
+// Пустой список Rooms означает "любая комната" (обратная совместимость).
+func (c *Claims) allowsRoom(room string) bool {
+	if len(c.Rooms) == 0 {
+		return true
+	}
+	for _, r := range c.Rooms {
+		if r == room {
+			return true
+		}
+	}
+	return false
+}
+
+// extractToken достаёт JWT из заголовка Authorization: Bearer ... или из
+// query-параметра ?token=, в таком порядке приоритета
+func extractToken(r *http.Request) string {
+	if auth := r.Header.Get("Authorization"); auth != "" {
+		const prefix = "Bearer "
+		if strings.HasPrefix(auth, prefix) {
+			return strings.TrimSpace(auth[len(prefix):])
+		}
+	}
+	return r.URL.Query().Get("token")
+}
+
+// parseToken проверяет подпись и срок действия и возвращает claims
+func parseToken(tokenString, secret string) (*Claims, error) {
+	if tokenString == "" {
+		return nil, errMissingToken
+	}
+
+	claims := &Claims{}
+	token, err := jwt.ParseWithClaims(tokenString, claims, func(t *jwt.Token) (interface{}, error) {
+		if _, ok := t.Method.(*jwt.SigningMethodHMAC); !ok {
+			return nil, jwt.ErrSignatureInvalid
+		}
+		return []byte(secret), nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if !token.Valid {
+		return nil, jwt.ErrTokenInvalidClaims
+	}
+
+	return claims, nil
+}
+
+// tokenMiddleware защищает обычные HTTP-обработчики (например /send):
+// требует валидный токен и, если requirePublish, claim can_publish.
+func tokenMiddleware(secret string, requirePublish bool, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		claims, err := parseToken(extractToken(r), secret)
+		if err != nil {
+			http.Error(w, "invalid or missing token", http.StatusUnauthorized)
+			return
+		}
+		if requirePublish && !claims.CanPublish {
+			http.Error(w, "token does not allow publishing", http.StatusForbidden)
+			return
+		}
+
+		r = withClaims(r, claims)
+		next(w, r)
+	}
+}
+
+// monitorAuth периодически перепроверяет срок действия токена на живом
+// WebSocket-соединении и обрывает его close-фреймом, если токен истёк.
+func monitorAuth(c *Client, claims *Claims) {
+	ticker := time.NewTicker(authRecheckPeriod)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if claims.ExpiresAt != nil && time.Now().After(claims.ExpiresAt.Time) {
+				closeWithCode(c, closeInvalidToken, "token expired")
+				return
+			}
+		case <-c.closed:
+			return
+		}
+	}
+}
+
+// closeWithCode отправляет close-фрейм с заданным кодом и останавливает клиента
+func closeWithCode(c *Client, code int, reason string) {
+	msg := websocket.FormatCloseMessage(code, reason)
+	c.conn.WriteControl(websocket.CloseMessage, msg, time.Now().Add(writeWait))
+	c.hub.unregister <- c
+}
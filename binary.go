@@ -0,0 +1,70 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+)
+
+// BinaryHeader - маршрутная информация для бинарного кадра, ровно то же
+// самое, что Room/UserIDs у Message. Кодируется в начале бинарного фрейма
+// как "маленький заголовок + непрозрачная нагрузка".
+type BinaryHeader struct {
+	Room    string   `json:"room,omitempty"`
+	UserIDs []string `json:"user_ids,omitempty"`
+}
+
+// encodeBinaryFrame собирает кадр клиента: 4 байта big-endian длины
+// заголовка, сам JSON-заголовок, затем непрозрачный payload
+func encodeBinaryFrame(header BinaryHeader, payload []byte) ([]byte, error) {
+	headerJSON, err := json.Marshal(header)
+	if err != nil {
+		return nil, err
+	}
+
+	frame := make([]byte, 4+len(headerJSON)+len(payload))
+	binary.BigEndian.PutUint32(frame[:4], uint32(len(headerJSON)))
+	copy(frame[4:], headerJSON)
+	copy(frame[4+len(headerJSON):], payload)
+
+	return frame, nil
+}
+
+// decodeBinaryFrame делает обратное: достаёт заголовок и payload из кадра,
+// присланного клиентом
+func decodeBinaryFrame(frame []byte) (BinaryHeader, []byte, error) {
+	var header BinaryHeader
+
+	if len(frame) < 4 {
+		return header, nil, fmt.Errorf("binary frame too short: %d bytes", len(frame))
+	}
+
+	headerLen := binary.BigEndian.Uint32(frame[:4])
+	if uint64(headerLen) > uint64(len(frame))-4 {
+		return header, nil, fmt.Errorf("binary frame header length %d exceeds frame size %d", headerLen, len(frame))
+	}
+
+	if err := json.Unmarshal(frame[4:4+headerLen], &header); err != nil {
+		return header, nil, err
+	}
+
+	return header, frame[4+headerLen:], nil
+}
+
+// wireEncode/wireDecode добавляют/снимают однобайтовый префикс с типом
+// кадра (websocket.TextMessage/websocket.BinaryMessage). Это нужно, чтобы
+// тип кадра пережил проход через Broker (включая Redis Pub/Sub между
+// узлами), который оперирует непрозрачными []byte.
+func wireEncode(kind int, payload []byte) []byte {
+	framed := make([]byte, 1+len(payload))
+	framed[0] = byte(kind)
+	copy(framed[1:], payload)
+	return framed
+}
+
+func wireDecode(framed []byte) (kind int, payload []byte) {
+	if len(framed) == 0 {
+		return 0, nil
+	}
+	return int(framed[0]), framed[1:]
+}
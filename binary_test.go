@@ -0,0 +1,147 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestEncodeDecodeBinaryFrameRoundTrip(t *testing.T) {
+	header := BinaryHeader{Room: "lobby", UserIDs: []string{"alice", "bob"}}
+	payload := bytes.Repeat([]byte{0xAB}, 64*1024)
+
+	frame, err := encodeBinaryFrame(header, payload)
+	if err != nil {
+		t.Fatalf("encodeBinaryFrame: %v", err)
+	}
+
+	gotHeader, gotPayload, err := decodeBinaryFrame(frame)
+	if err != nil {
+		t.Fatalf("decodeBinaryFrame: %v", err)
+	}
+	if gotHeader.Room != header.Room || len(gotHeader.UserIDs) != len(header.UserIDs) {
+		t.Fatalf("got header %+v, want %+v", gotHeader, header)
+	}
+	if !bytes.Equal(gotPayload, payload) {
+		t.Fatalf("payload mismatch after round trip, got %d bytes want %d bytes", len(gotPayload), len(payload))
+	}
+}
+
+func TestWireEncodeDecodeRoundTrip(t *testing.T) {
+	payload := []byte("hello")
+	framed := wireEncode(websocket.BinaryMessage, payload)
+
+	kind, got := wireDecode(framed)
+	if kind != websocket.BinaryMessage {
+		t.Fatalf("got kind %d, want %d", kind, websocket.BinaryMessage)
+	}
+	if !bytes.Equal(got, payload) {
+		t.Fatalf("got payload %q, want %q", got, payload)
+	}
+}
+
+// newTestServer запускает handleWebSocket поверх httptest.Server без auth и
+// без персистентности - для проверки только транспортного уровня.
+func newTestServer(t *testing.T, compression bool) (*httptest.Server, *Hub) {
+	t.Helper()
+	return newTestServerWithStore(t, compression, noopStore{})
+}
+
+// newTestServerWithStore - то же самое, но с переданным Store, для тестов,
+// которым нужны реальные seq (noopStore всегда возвращает 0).
+func newTestServerWithStore(t *testing.T, compression bool, store Store) (*httptest.Server, *Hub) {
+	t.Helper()
+
+	hub := newHub(newLocalBroker(), store)
+	go hub.run()
+
+	level := 0
+	if compression {
+		upgrader.EnableCompression = true
+	} else {
+		upgrader.EnableCompression = false
+	}
+	t.Cleanup(func() { upgrader.EnableCompression = false })
+
+	handler := handleWebSocket(hub, store, "", compression, level)
+	server := httptest.NewServer(handler)
+	t.Cleanup(server.Close)
+
+	return server, hub
+}
+
+func dialTestServer(t *testing.T, server *httptest.Server, roomID, userID string, compression bool) (*websocket.Conn, *http.Response) {
+	t.Helper()
+
+	wsURL, err := url.Parse(server.URL)
+	if err != nil {
+		t.Fatalf("url.Parse: %v", err)
+	}
+	wsURL.Scheme = "ws"
+	q := wsURL.Query()
+	q.Set("room_id", roomID)
+	q.Set("user_id", userID)
+	wsURL.RawQuery = q.Encode()
+
+	dialer := websocket.Dialer{EnableCompression: compression}
+	conn, resp, err := dialer.Dial(wsURL.String(), nil)
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	return conn, resp
+}
+
+func TestBinaryFrameRoundTripOverWebSocket(t *testing.T) {
+	server, _ := newTestServer(t, false)
+
+	sender, _ := dialTestServer(t, server, "", "alice", false)
+	defer sender.Close()
+	receiver, _ := dialTestServer(t, server, "lobby", "bob", false)
+	defer receiver.Close()
+
+	payload := bytes.Repeat([]byte{0x42}, 256*1024)
+	frame, err := encodeBinaryFrame(BinaryHeader{Room: "lobby"}, payload)
+	if err != nil {
+		t.Fatalf("encodeBinaryFrame: %v", err)
+	}
+
+	if err := sender.WriteMessage(websocket.BinaryMessage, frame); err != nil {
+		t.Fatalf("WriteMessage: %v", err)
+	}
+
+	messageType, got, err := receiver.ReadMessage()
+	if err != nil {
+		t.Fatalf("ReadMessage: %v", err)
+	}
+	if messageType != websocket.BinaryMessage {
+		t.Fatalf("got message type %d, want %d", messageType, websocket.BinaryMessage)
+	}
+	if !bytes.Equal(got, payload) {
+		t.Fatalf("payload mismatch, got %d bytes want %d bytes", len(got), len(payload))
+	}
+}
+
+func TestCompressionNegotiated(t *testing.T) {
+	server, _ := newTestServer(t, true)
+
+	_, resp := dialTestServer(t, server, "", "alice", true)
+	ext := resp.Header.Get("Sec-WebSocket-Extensions")
+	if !strings.Contains(ext, "permessage-deflate") {
+		t.Fatalf("Sec-WebSocket-Extensions = %q, want it to contain permessage-deflate", ext)
+	}
+}
+
+func TestCompressionNotNegotiatedWhenDisabled(t *testing.T) {
+	server, _ := newTestServer(t, false)
+
+	_, resp := dialTestServer(t, server, "", "alice", true)
+	ext := resp.Header.Get("Sec-WebSocket-Extensions")
+	if strings.Contains(ext, "permessage-deflate") {
+		t.Fatalf("Sec-WebSocket-Extensions = %q, did not expect permessage-deflate when server compression is disabled", ext)
+	}
+}
@@ -0,0 +1,75 @@
+package main
+
+import "log"
+
+// Broker отвечает за доставку сообщений между узлами кластера. Hub публикует
+// через Broker и подписывается на него же, так что для одного процесса
+// (LocalBroker) поведение не меняется, а для нескольких (RedisBroker)
+// сообщение, опубликованное на одном узле, попадает в подписку на всех.
+type Broker interface {
+	PublishRoom(room string, payload []byte) error
+	PublishUser(userID string, payload []byte) error
+
+	// SubscribeRoom/SubscribeUser регистрируют обработчик, который будет
+	// вызван при получении сообщения - локально опубликованного или
+	// пришедшего от другого узла. Вызываются один раз при старте хаба.
+	SubscribeRoom(handler func(room string, payload []byte))
+	SubscribeUser(handler func(userID string, payload []byte))
+
+	// JoinRoom/LeaveRoom мирроят членство в комнате во внешнее хранилище,
+	// чтобы другие узлы знали, кто в какой комнате (у LocalBroker - no-op)
+	JoinRoom(room, userID string) error
+	LeaveRoom(room, userID string) error
+
+	Close() error
+}
+
+// LocalBroker - поведение по умолчанию для одного процесса: публикация
+// сразу же доставляется подписчику в той же горутине, без сети.
+type LocalBroker struct {
+	roomHandler func(room string, payload []byte)
+	userHandler func(userID string, payload []byte)
+}
+
+func newLocalBroker() *LocalBroker {
+	return &LocalBroker{}
+}
+
+func (b *LocalBroker) PublishRoom(room string, payload []byte) error {
+	if b.roomHandler != nil {
+		b.roomHandler(room, payload)
+	}
+	return nil
+}
+
+func (b *LocalBroker) PublishUser(userID string, payload []byte) error {
+	if b.userHandler != nil {
+		b.userHandler(userID, payload)
+	}
+	return nil
+}
+
+func (b *LocalBroker) SubscribeRoom(handler func(room string, payload []byte)) {
+	b.roomHandler = handler
+}
+
+func (b *LocalBroker) SubscribeUser(handler func(userID string, payload []byte)) {
+	b.userHandler = handler
+}
+
+func (b *LocalBroker) JoinRoom(room, userID string) error  { return nil }
+func (b *LocalBroker) LeaveRoom(room, userID string) error { return nil }
+func (b *LocalBroker) Close() error                        { return nil }
+
+// newBroker выбирает реализацию по конфигу
+func newBroker(cfg *Config) (Broker, error) {
+	switch cfg.Broker {
+	case "", "local":
+		return newLocalBroker(), nil
+	case "redis":
+		return newRedisBroker(cfg.RedisURL)
+	default:
+		log.Printf("Unknown broker %q, falling back to local", cfg.Broker)
+		return newLocalBroker(), nil
+	}
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+const (
+	// Время ожидания записи сообщения клиенту
+	writeWait = 10 * time.Second
+	// Время ожидания pong-ответа от клиента
+	pongWait = 60 * time.Second
+	// Период отправки ping; должен быть меньше pongWait
+	pingPeriod = 54 * time.Second
+	// Максимальный размер входящего сообщения. Поднят относительно старых
+	// 8KB, чтобы вмещать бинарные кадры (мелкие изображения, protobuf и т.п.)
+	maxMessageSize = 1 << 20
+	// Размер буфера исходящих сообщений клиента
+	sendBufSize = 256
+)
+
+// outboundFrame - то, что реально уходит в conn.WriteMessage: тип кадра
+// (websocket.TextMessage/BinaryMessage) вместе с данными
+type outboundFrame struct {
+	kind    int
+	payload []byte
+}
+
+// Client хранит WebSocket-соединение с привязкой к пользователю.
+// conn читает только readPump, пишет только writePump - это единственный
+// писатель в соединение, как того требует gorilla/websocket.
+type Client struct {
+	hub    *Hub
+	conn   *websocket.Conn
+	id     string
+	send   chan outboundFrame
+	rooms  map[string]bool
+	claims *Claims       // claims предъявленного токена, nil если auth отключена
+	closed chan struct{} // закрывается при остановке readPump, сигнал для monitorAuth
+}
+
+// readPump читает сообщения от клиента и передаёт их хабу на маршрутизацию.
+// Завершается при ошибке чтения или закрытии соединения.
+func (c *Client) readPump() {
+	defer func() {
+		close(c.closed)
+		c.hub.unregister <- c
+		c.conn.Close()
+	}()
+
+	c.conn.SetReadLimit(maxMessageSize)
+	c.conn.SetReadDeadline(time.Now().Add(pongWait))
+	c.conn.SetPongHandler(func(string) error {
+		c.conn.SetReadDeadline(time.Now().Add(pongWait))
+		return nil
+	})
+
+	for {
+		messageType, msg, err := c.conn.ReadMessage()
+		if err != nil {
+			if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseAbnormalClosure) {
+				log.Printf("Error reading message from %s: %v", c.id, err)
+			}
+			break
+		}
+
+		if messageType == websocket.BinaryMessage {
+			c.handleBinaryFrame(msg)
+			continue
+		}
+
+		var msgObj Message
+		if err := json.Unmarshal(msg, &msgObj); err != nil {
+			log.Printf("Error unmarshalling message from %s: %v", c.id, err)
+			c.sendError(errCodeBadRequest, "invalid message: "+err.Error())
+			continue
+		}
+
+		switch msgObj.Type {
+		case msgTypeJoin:
+			c.handleJoin(msgObj)
+		case msgTypeLeave:
+			c.handleLeave(msgObj)
+		case msgTypeListRooms:
+			c.handleListRooms()
+		case msgTypeListPeers:
+			c.handleListPeers(msgObj)
+		case msgTypeTyping:
+			c.handleTyping(msgObj)
+		case msgTypeAck, msgTypePresence, msgTypeError:
+			c.sendError(errCodeBadRequest, "type "+msgObj.Type+" is server-only")
+		default:
+			if msgObj.Room != "" && c.claims != nil && !c.claims.allowsRoom(msgObj.Room) {
+				log.Printf("User %s not allowed to publish to room %s", c.id, msgObj.Room)
+				c.sendError(errCodeForbidden, "not allowed to publish to room "+msgObj.Room)
+				continue
+			}
+			if c.claims != nil && !c.claims.CanPublish {
+				log.Printf("User %s token does not allow publishing", c.id)
+				c.sendError(errCodeForbidden, "token does not allow publishing")
+				continue
+			}
+			c.hub.route(c.id, msgObj, msg)
+		}
+	}
+}
+
+// handleBinaryFrame разбирает бинарный кадр клиента (заголовок + opaque
+// payload) и передаёт его хабу на маршрутизацию, минуя JSON
+func (c *Client) handleBinaryFrame(frame []byte) {
+	header, payload, err := decodeBinaryFrame(frame)
+	if err != nil {
+		log.Printf("Error decoding binary frame from %s: %v", c.id, err)
+		c.sendError(errCodeBadRequest, "invalid binary frame: "+err.Error())
+		return
+	}
+
+	if header.Room != "" && c.claims != nil && !c.claims.allowsRoom(header.Room) {
+		log.Printf("User %s not allowed to publish binary to room %s", c.id, header.Room)
+		c.sendError(errCodeForbidden, "not allowed to publish to room "+header.Room)
+		return
+	}
+	if c.claims != nil && !c.claims.CanPublish {
+		log.Printf("User %s token does not allow publishing", c.id)
+		c.sendError(errCodeForbidden, "token does not allow publishing")
+		return
+	}
+
+	c.hub.routeBinary(header, payload)
+}
+
+// sendError отправляет клиенту структурированный error-фрейм вместо того,
+// чтобы молча залогировать проблему. Не блокирует readPump: буфер
+// переполнен - кадр просто теряется, как и при обычном sendOrDrop.
+func (c *Client) sendError(code int, reason string) {
+	payload, err := json.Marshal(Message{Type: msgTypeError, Code: code, Message: reason})
+	if err != nil {
+		log.Printf("Error marshalling error frame for %s: %v", c.id, err)
+		return
+	}
+
+	select {
+	case c.send <- outboundFrame{kind: websocket.TextMessage, payload: payload}:
+	default:
+		log.Printf("Client %s send buffer full, dropping error frame", c.id)
+	}
+}
+
+// writePump - единственная горутина, пишущая в соединение. Забирает
+// сообщения из send-буфера и периодически шлёт ping для keepalive.
+func (c *Client) writePump() {
+	ticker := time.NewTicker(pingPeriod)
+	defer func() {
+		ticker.Stop()
+		c.conn.Close()
+	}()
+
+	for {
+		select {
+		case frame, ok := <-c.send:
+			c.conn.SetWriteDeadline(time.Now().Add(writeWait))
+			if !ok {
+				// Хаб закрыл канал - клиент отключён, шлём close frame
+				c.conn.WriteMessage(websocket.CloseMessage, []byte{})
+				return
+			}
+
+			if err := c.conn.WriteMessage(frame.kind, frame.payload); err != nil {
+				log.Printf("Error sending message to %s: %v", c.id, err)
+				return
+			}
+
+		case <-ticker.C:
+			c.conn.SetWriteDeadline(time.Now().Add(writeWait))
+			if err := c.conn.WriteMessage(websocket.PingMessage, nil); err != nil {
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+
+	"github.com/gorilla/websocket"
+)
+
+// Типы Message.Type. Пустой Type (или "message") - обычный broadcast/direct,
+// как было раньше; остальные - служебные кадры протокола.
+const (
+	msgTypeJoin      = "join"
+	msgTypeLeave     = "leave"
+	msgTypeListRooms = "list_rooms"
+	msgTypeListPeers = "list_peers"
+	msgTypeTyping    = "typing"
+	msgTypePresence  = "presence" // только сервер -> клиент
+	msgTypeAck       = "ack"      // только сервер -> клиент
+	msgTypeError     = "error"    // только сервер -> клиент
+)
+
+// Коды structured error-фреймов, отправляемых клиенту
+const (
+	errCodeBadRequest = 4400 // неразбираемое сообщение или некорректный запрос
+	errCodeForbidden  = 4403 // не разрешено токеном
+)
+
+// Статусы presence-события
+const (
+	presenceJoin  = "join"
+	presenceLeave = "leave"
+)
+
+// handleJoin обрабатывает {"type":"join","room":"..."}: проверяет ACL,
+// добавляет клиента в комнату, шлёт ack и presence остальным участникам.
+func (c *Client) handleJoin(msg Message) {
+	if msg.Room == "" {
+		c.sendError(errCodeBadRequest, "join requires room")
+		return
+	}
+	if c.claims != nil && !c.claims.allowsRoom(msg.Room) {
+		c.sendError(errCodeForbidden, "not allowed to join room "+msg.Room)
+		return
+	}
+	if c.claims != nil && !c.claims.CanPublish {
+		c.sendError(errCodeForbidden, "token does not allow publishing")
+		return
+	}
+
+	// presence шлём до joinRoom, пока сам клиент ещё не числится участником
+	// комнаты - иначе он получит собственное presence-событие о своём же входе.
+	c.broadcastPresence(msg.Room, presenceJoin)
+	c.hub.joinRoom(c.id, msg.Room)
+	c.ack(msg.Room)
+}
+
+// handleLeave обрабатывает {"type":"leave","room":"..."}: убирает клиента
+// из комнаты (остальные комнаты не трогает) и шлёт ack + presence.
+func (c *Client) handleLeave(msg Message) {
+	if msg.Room == "" {
+		c.sendError(errCodeBadRequest, "leave requires room")
+		return
+	}
+
+	c.hub.leaveRoom(c.id, msg.Room)
+	c.ack(msg.Room)
+	c.broadcastPresence(msg.Room, presenceLeave)
+}
+
+// handleListRooms отвечает списком комнат, в которых сейчас состоит клиент
+func (c *Client) handleListRooms() {
+	c.sendControl(Message{Type: msgTypeListRooms, Rooms: c.hub.roomsFor(c.id)})
+}
+
+// handleListPeers отвечает списком участников запрошенной комнаты
+func (c *Client) handleListPeers(msg Message) {
+	if msg.Room == "" {
+		c.sendError(errCodeBadRequest, "list_peers requires room")
+		return
+	}
+	c.sendControl(Message{Type: msgTypeListPeers, Room: msg.Room, UserIDs: c.hub.peersIn(msg.Room)})
+}
+
+// handleTyping рассылает индикатор печати остальным участникам комнаты.
+// Эфемерно - не проходит через Store и не получает seq.
+func (c *Client) handleTyping(msg Message) {
+	if msg.Room == "" {
+		c.sendError(errCodeBadRequest, "typing requires room")
+		return
+	}
+	if c.claims != nil && !c.claims.allowsRoom(msg.Room) {
+		c.sendError(errCodeForbidden, "not allowed to publish to room "+msg.Room)
+		return
+	}
+	if c.claims != nil && !c.claims.CanPublish {
+		c.sendError(errCodeForbidden, "token does not allow publishing")
+		return
+	}
+
+	c.publishToRoom(Message{Type: msgTypeTyping, Room: msg.Room, UserIDs: []string{c.id}})
+}
+
+// broadcastPresence уведомляет участников комнаты о том, что userID
+// присоединился/вышел
+func (c *Client) broadcastPresence(room, status string) {
+	c.publishToRoom(Message{Type: msgTypePresence, Room: room, Message: status, UserIDs: []string{c.id}})
+}
+
+// ack подтверждает клиенту выполнение join/leave
+func (c *Client) ack(room string) {
+	c.sendControl(Message{Type: msgTypeAck, Room: room})
+}
+
+// publishToRoom кодирует служебное сообщение и рассылает его всей комнате
+// в обход Store (presence/typing не персистятся)
+func (c *Client) publishToRoom(msg Message) {
+	payload, err := json.Marshal(msg)
+	if err != nil {
+		log.Printf("Error marshalling %s for room %s: %v", msg.Type, msg.Room, err)
+		return
+	}
+	c.hub.publishControl(msg.Room, payload)
+}
+
+// sendControl кодирует служебное сообщение и кладёт его только в буфер
+// этого клиента (ответ на list_rooms/list_peers/ack, не рассылка)
+func (c *Client) sendControl(msg Message) {
+	payload, err := json.Marshal(msg)
+	if err != nil {
+		log.Printf("Error marshalling %s for %s: %v", msg.Type, c.id, err)
+		return
+	}
+
+	select {
+	case c.send <- outboundFrame{kind: websocket.TextMessage, payload: payload}:
+	default:
+		log.Printf("Client %s send buffer full, dropping %s frame", c.id, msg.Type)
+	}
+}
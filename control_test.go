@@ -0,0 +1,208 @@
+package main
+
+import (
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+const testReadTimeout = 2 * time.Second
+
+func sendJSON(t *testing.T, conn *websocket.Conn, msg Message) {
+	t.Helper()
+	if err := conn.WriteJSON(msg); err != nil {
+		t.Fatalf("WriteJSON: %v", err)
+	}
+}
+
+func readJSON(t *testing.T, conn *websocket.Conn) Message {
+	t.Helper()
+	if err := conn.SetReadDeadline(time.Now().Add(testReadTimeout)); err != nil {
+		t.Fatalf("SetReadDeadline: %v", err)
+	}
+	var msg Message
+	if err := conn.ReadJSON(&msg); err != nil {
+		t.Fatalf("ReadJSON: %v", err)
+	}
+	return msg
+}
+
+func dial(t *testing.T, server *httptest.Server, userID string) *websocket.Conn {
+	t.Helper()
+	conn, _ := dialTestServer(t, server, "", userID, false)
+	return conn
+}
+
+// joinAndAck sends a join for room and waits for its ack, so the caller
+// knows membership has taken effect before triggering anything else.
+func joinAndAck(t *testing.T, conn *websocket.Conn, room string) {
+	t.Helper()
+	sendJSON(t, conn, Message{Type: msgTypeJoin, Room: room})
+	ack := readJSON(t, conn)
+	if ack.Type != msgTypeAck || ack.Room != room {
+		t.Fatalf("got %+v, want join ack for %s", ack, room)
+	}
+}
+
+func TestControlJoinLeaveAndPresence(t *testing.T) {
+	server, _ := newTestServer(t, false)
+
+	alice := dial(t, server, "alice")
+	defer alice.Close()
+	bob := dial(t, server, "bob")
+	defer bob.Close()
+
+	joinAndAck(t, bob, "lobby")
+
+	sendJSON(t, alice, Message{Type: msgTypeJoin, Room: "lobby"})
+
+	ack := readJSON(t, alice)
+	if ack.Type != msgTypeAck || ack.Room != "lobby" {
+		t.Fatalf("got ack %+v, want join ack for lobby", ack)
+	}
+
+	presence := readJSON(t, bob)
+	if presence.Type != msgTypePresence || presence.Message != presenceJoin || len(presence.UserIDs) != 1 || presence.UserIDs[0] != "alice" {
+		t.Fatalf("got presence %+v, want alice join presence", presence)
+	}
+
+	sendJSON(t, alice, Message{Type: msgTypeLeave, Room: "lobby"})
+
+	leaveAck := readJSON(t, alice)
+	if leaveAck.Type != msgTypeAck || leaveAck.Room != "lobby" {
+		t.Fatalf("got ack %+v, want leave ack for lobby", leaveAck)
+	}
+
+	leavePresence := readJSON(t, bob)
+	if leavePresence.Type != msgTypePresence || leavePresence.Message != presenceLeave {
+		t.Fatalf("got presence %+v, want alice leave presence", leavePresence)
+	}
+}
+
+func TestControlPresenceOnDisconnect(t *testing.T) {
+	server, _ := newTestServer(t, false)
+
+	alice := dial(t, server, "alice")
+	bob := dial(t, server, "bob")
+	defer bob.Close()
+
+	joinAndAck(t, bob, "lobby")
+	joinAndAck(t, alice, "lobby")
+	readJSON(t, bob) // alice's join presence
+
+	alice.Close()
+
+	presence := readJSON(t, bob)
+	if presence.Type != msgTypePresence || presence.Message != presenceLeave || presence.UserIDs[0] != "alice" {
+		t.Fatalf("got presence %+v, want alice leave presence on disconnect", presence)
+	}
+}
+
+func TestControlListRoomsAndListPeers(t *testing.T) {
+	server, _ := newTestServer(t, false)
+
+	alice := dial(t, server, "alice")
+	defer alice.Close()
+	bob := dial(t, server, "bob")
+	defer bob.Close()
+
+	joinAndAck(t, alice, "lobby")
+	joinAndAck(t, bob, "lobby")
+	readJSON(t, alice) // bob's join presence
+
+	sendJSON(t, alice, Message{Type: msgTypeListRooms})
+	rooms := readJSON(t, alice)
+	if rooms.Type != msgTypeListRooms || len(rooms.Rooms) != 1 || rooms.Rooms[0] != "lobby" {
+		t.Fatalf("got %+v, want rooms=[lobby]", rooms)
+	}
+
+	sendJSON(t, alice, Message{Type: msgTypeListPeers, Room: "lobby"})
+	peers := readJSON(t, alice)
+	if peers.Type != msgTypeListPeers || peers.Room != "lobby" || len(peers.UserIDs) != 2 {
+		t.Fatalf("got %+v, want 2 peers in lobby", peers)
+	}
+}
+
+func TestControlTyping(t *testing.T) {
+	server, _ := newTestServer(t, false)
+
+	alice := dial(t, server, "alice")
+	defer alice.Close()
+	bob := dial(t, server, "bob")
+	defer bob.Close()
+
+	joinAndAck(t, bob, "lobby")
+	joinAndAck(t, alice, "lobby")
+	readJSON(t, bob) // alice's join presence
+
+	sendJSON(t, alice, Message{Type: msgTypeTyping, Room: "lobby"})
+
+	typing := readJSON(t, bob)
+	if typing.Type != msgTypeTyping || typing.Room != "lobby" || len(typing.UserIDs) != 1 || typing.UserIDs[0] != "alice" {
+		t.Fatalf("got %+v, want alice typing in lobby", typing)
+	}
+}
+
+func TestControlAckOnRoomBroadcast(t *testing.T) {
+	store, err := newBoltStore(t.TempDir() + "/history.db")
+	if err != nil {
+		t.Fatalf("newBoltStore: %v", err)
+	}
+	t.Cleanup(func() { store.Close() })
+
+	server, _ := newTestServerWithStore(t, false, store)
+
+	alice := dial(t, server, "alice")
+	defer alice.Close()
+
+	joinAndAck(t, alice, "lobby")
+
+	sendJSON(t, alice, Message{Room: "lobby", Message: "hi"})
+
+	first := readJSON(t, alice)
+	second := readJSON(t, alice)
+
+	var ack, broadcast Message
+	if first.Type == msgTypeAck {
+		ack, broadcast = first, second
+	} else {
+		ack, broadcast = second, first
+	}
+
+	if ack.Type != msgTypeAck || ack.Room != "lobby" {
+		t.Fatalf("got ack %+v, want ack for lobby", ack)
+	}
+	if broadcast.Message != "hi" || broadcast.Seq == 0 {
+		t.Fatalf("got broadcast %+v, want \"hi\" with a non-zero seq", broadcast)
+	}
+}
+
+func TestControlServerOnlyTypeRejected(t *testing.T) {
+	server, _ := newTestServer(t, false)
+
+	alice := dial(t, server, "alice")
+	defer alice.Close()
+
+	sendJSON(t, alice, Message{Type: msgTypePresence, Room: "lobby"})
+
+	errMsg := readJSON(t, alice)
+	if errMsg.Type != msgTypeError || errMsg.Code != errCodeBadRequest {
+		t.Fatalf("got %+v, want bad_request error for server-only type", errMsg)
+	}
+}
+
+func TestControlMissingRoomIsError(t *testing.T) {
+	server, _ := newTestServer(t, false)
+
+	alice := dial(t, server, "alice")
+	defer alice.Close()
+
+	sendJSON(t, alice, Message{Type: msgTypeJoin})
+
+	errMsg := readJSON(t, alice)
+	if errMsg.Type != msgTypeError || errMsg.Code != errCodeBadRequest {
+		t.Fatalf("got %+v, want bad_request error for join without room", errMsg)
+	}
+}
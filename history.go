@@ -0,0 +1,61 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+
+	"github.com/gorilla/websocket"
+)
+
+// historyReplayLimit ограничивает, сколько сообщений отдаётся клиенту при
+// подключении с ?last_seq= и сколько возвращает /history по умолчанию
+const historyReplayLimit = 200
+
+// historyHandler обслуживает GET /history?room=...&since=...&limit=...
+func historyHandler(store Store) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		room := r.URL.Query().Get("room")
+		if room == "" {
+			http.Error(w, "room is required", http.StatusBadRequest)
+			return
+		}
+
+		since, _ := strconv.ParseUint(r.URL.Query().Get("since"), 10, 64)
+
+		limit := historyReplayLimit
+		if l, err := strconv.Atoi(r.URL.Query().Get("limit")); err == nil && l > 0 {
+			limit = l
+		}
+
+		messages, err := store.Since(room, since, limit)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(messages); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+	}
+}
+
+// replayHistory отправляет клиенту сообщения комнаты с seq больше lastSeq,
+// до того как он начнёт получать живые сообщения. Вызывается до запуска
+// writePump, поэтому просто пишет в буферизованный send-канал клиента.
+func replayHistory(client *Client, store Store, room string, lastSeq uint64) {
+	history, err := store.Since(room, lastSeq, historyReplayLimit)
+	if err != nil {
+		return
+	}
+
+	for _, stored := range history {
+		stored.Message.Seq = stored.Seq
+		payload, err := json.Marshal(stored.Message)
+		if err != nil {
+			continue
+		}
+		client.send <- outboundFrame{kind: websocket.TextMessage, payload: payload}
+	}
+}
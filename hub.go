@@ -0,0 +1,343 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// roomMessage - сообщение для рассылки всем участникам комнаты. Для
+// текстовых (JSON) сообщений передаём разобранный Message, потому что seq
+// для него проставляется хабом из Store только перед самой отправкой в
+// broker; для бинарных кадров seq не проставляется и несётся rawPayload.
+type roomMessage struct {
+	room       string
+	kind       int // websocket.TextMessage или websocket.BinaryMessage
+	msg        Message
+	rawPayload []byte
+	sender     string // userID отправителя, для ack; пусто, если ack не нужен
+}
+
+// directMessage - сообщение для конкретного списка пользователей
+type directMessage struct {
+	userIDs []string
+	kind    int
+	payload []byte
+}
+
+// Hub владеет списком клиентов и комнат и является единственным местом,
+// где эти структуры изменяются. Рассылка и регистрация идут через каналы,
+// поэтому readPump/writePump и HTTP-хендлеры никогда не трогают map'ы напрямую.
+type Hub struct {
+	mu      sync.RWMutex
+	clients map[string]*Client
+	rooms   map[string]map[string]bool // roomID -> set of userID
+
+	broker Broker
+	store  Store
+
+	register   chan *Client
+	unregister chan *Client
+	broadcast  chan roomMessage
+	direct     chan directMessage
+}
+
+func newHub(broker Broker, store Store) *Hub {
+	h := &Hub{
+		clients:    make(map[string]*Client),
+		rooms:      make(map[string]map[string]bool),
+		broker:     broker,
+		store:      store,
+		register:   make(chan *Client),
+		unregister: make(chan *Client),
+		broadcast:  make(chan roomMessage),
+		direct:     make(chan directMessage),
+	}
+
+	// Доставка всегда идёт через broker, даже для локальных подписчиков -
+	// так LocalBroker и RedisBroker ведут себя одинаково с точки зрения Hub.
+	h.broker.SubscribeRoom(h.deliverRoom)
+	h.broker.SubscribeUser(h.deliverUser)
+
+	return h
+}
+
+// run - основной цикл хаба, должен выполняться в отдельной горутине
+func (h *Hub) run() {
+	for {
+		select {
+		case c := <-h.register:
+			h.mu.Lock()
+			h.clients[c.id] = c
+			h.mu.Unlock()
+			metricConnectedClients.Inc()
+			log.Printf("User %s connected", c.id)
+
+		case c := <-h.unregister:
+			h.mu.Lock()
+			var leftRooms []string
+			if current, ok := h.clients[c.id]; ok && current == c {
+				delete(h.clients, c.id)
+				for room := range c.rooms {
+					delete(h.rooms[room], c.id)
+					leftRooms = append(leftRooms, room)
+				}
+				close(c.send)
+				metricConnectedClients.Dec()
+			}
+			h.mu.Unlock()
+
+			// broker/presence вызываются вне блокировки: PublishRoom у
+			// LocalBroker синхронно доходит до deliverRoom, которому нужен
+			// тот же h.mu - держать лок здесь означало бы дедлок.
+			for _, room := range leftRooms {
+				if err := h.broker.LeaveRoom(room, c.id); err != nil {
+					log.Printf("Error leaving room %s in broker: %v", room, err)
+				}
+				h.publishPresence(room, c.id, presenceLeave)
+			}
+			log.Printf("User %s disconnected", c.id)
+
+		case m := <-h.broadcast:
+			timer := prometheus.NewTimer(metricBroadcastLatency)
+			metricMessagesTotal.WithLabelValues("in", m.room).Inc()
+
+			var wirePayload []byte
+			if m.kind == websocket.BinaryMessage {
+				wirePayload = wireEncode(websocket.BinaryMessage, m.rawPayload)
+			} else {
+				seq, err := h.store.Append(m.room, m.msg)
+				if err != nil {
+					log.Printf("Error appending to store for room %s: %v", m.room, err)
+				}
+				m.msg.Seq = seq
+
+				payload, err := json.Marshal(m.msg)
+				if err != nil {
+					log.Printf("Error marshalling message for room %s: %v", m.room, err)
+					timer.ObserveDuration()
+					continue
+				}
+				wirePayload = wireEncode(websocket.TextMessage, payload)
+
+				if m.sender != "" {
+					h.sendAck(m.sender, m.room, m.msg.Seq)
+				}
+			}
+
+			if err := h.broker.PublishRoom(m.room, wirePayload); err != nil {
+				log.Printf("Error publishing to room %s: %v", m.room, err)
+			}
+			timer.ObserveDuration()
+
+		case m := <-h.direct:
+			wirePayload := wireEncode(m.kind, m.payload)
+			for _, userID := range m.userIDs {
+				if err := h.broker.PublishUser(userID, wirePayload); err != nil {
+					log.Printf("Error publishing to user %s: %v", userID, err)
+				}
+			}
+		}
+	}
+}
+
+// deliverRoom рассылает сообщение локально подключённым участникам комнаты.
+// Вызывается broker'ом - синхронно для LocalBroker, из Pub/Sub горутины для RedisBroker.
+func (h *Hub) deliverRoom(room string, framed []byte) {
+	kind, payload := wireDecode(framed)
+
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	for userID := range h.rooms[room] {
+		if client, ok := h.clients[userID]; ok {
+			h.sendOrDrop(client, outboundFrame{kind: kind, payload: payload})
+			metricMessagesTotal.WithLabelValues("out", room).Inc()
+		}
+	}
+}
+
+// deliverUser доставляет сообщение конкретному пользователю, если он
+// подключён к этому узлу
+func (h *Hub) deliverUser(userID string, framed []byte) {
+	kind, payload := wireDecode(framed)
+
+	h.mu.RLock()
+	client, ok := h.clients[userID]
+	h.mu.RUnlock()
+
+	if ok {
+		h.sendOrDrop(client, outboundFrame{kind: kind, payload: payload})
+	}
+}
+
+// sendOrDrop пишет в буфер клиента, не блокируясь. Если буфер переполнен,
+// клиент считается медленным и отключается, а не блокирует весь broadcast.
+func (h *Hub) sendOrDrop(c *Client, frame outboundFrame) {
+	select {
+	case c.send <- frame:
+	default:
+		log.Printf("Client %s send buffer full, dropping connection", c.id)
+		metricDroppedSlowClients.Inc()
+		go func() { h.unregister <- c }()
+	}
+}
+
+// Shutdown закрывает все локально подключённые соединения close-фреймом
+// 1001 (going away), предварительно дав им drainTimeout на то, чтобы
+// дописать то, что уже лежит в их send-буфере.
+func (h *Hub) Shutdown(drainTimeout time.Duration) {
+	h.mu.RLock()
+	clients := make([]*Client, 0, len(h.clients))
+	for _, c := range h.clients {
+		clients = append(clients, c)
+	}
+	h.mu.RUnlock()
+
+	deadline := time.Now().Add(drainTimeout)
+
+	var wg sync.WaitGroup
+	for _, c := range clients {
+		wg.Add(1)
+		go func(c *Client) {
+			defer wg.Done()
+			for len(c.send) > 0 && time.Now().Before(deadline) {
+				time.Sleep(10 * time.Millisecond)
+			}
+			closeWithCode(c, websocket.CloseGoingAway, "server shutting down")
+		}(c)
+	}
+	wg.Wait()
+}
+
+// joinRoom добавляет пользователя в комнату, если он сейчас подключён
+func (h *Hub) joinRoom(userID, roomID string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.rooms[roomID] == nil {
+		h.rooms[roomID] = make(map[string]bool)
+	}
+	h.rooms[roomID][userID] = true
+
+	if client, ok := h.clients[userID]; ok {
+		client.rooms[roomID] = true
+	}
+
+	if err := h.broker.JoinRoom(roomID, userID); err != nil {
+		log.Printf("Error joining room %s in broker: %v", roomID, err)
+	}
+	log.Printf("User %s joined room %s", userID, roomID)
+}
+
+// route решает, куда отправить текстовое (JSON) сообщение, полученное от
+// клиента: в комнату (проходит через Store и получает seq) или напрямую
+// перечисленным UserIDs (payload - исходный JSON как есть). senderID
+// используется, чтобы отправителю ушёл ack с присвоенным seq.
+func (h *Hub) route(senderID string, msgObj Message, raw []byte) {
+	if msgObj.Room != "" {
+		h.broadcast <- roomMessage{room: msgObj.Room, kind: websocket.TextMessage, msg: msgObj, sender: senderID}
+	} else if len(msgObj.UserIDs) > 0 {
+		h.direct <- directMessage{userIDs: msgObj.UserIDs, kind: websocket.TextMessage, payload: raw}
+	}
+}
+
+// sendAck шлёт отправителю подтверждение с присвоенным seq. Получатель
+// всегда локален этому узлу, т.к. Store.Append выполняется в run() того
+// узла, на который пришло исходное сообщение.
+func (h *Hub) sendAck(senderID, room string, seq uint64) {
+	payload, err := json.Marshal(Message{Type: msgTypeAck, Room: room, Seq: seq})
+	if err != nil {
+		log.Printf("Error marshalling ack for %s: %v", senderID, err)
+		return
+	}
+
+	h.mu.RLock()
+	client, ok := h.clients[senderID]
+	h.mu.RUnlock()
+	if ok {
+		h.sendOrDrop(client, outboundFrame{kind: websocket.TextMessage, payload: payload})
+	}
+}
+
+// leaveRoom убирает пользователя из одной конкретной комнаты, не трогая
+// остальные его комнаты и не закрывая соединение (в отличие от unregister)
+func (h *Hub) leaveRoom(userID, roomID string) {
+	h.mu.Lock()
+	if h.rooms[roomID] != nil {
+		delete(h.rooms[roomID], userID)
+	}
+	if client, ok := h.clients[userID]; ok {
+		delete(client.rooms, roomID)
+	}
+	h.mu.Unlock()
+
+	if err := h.broker.LeaveRoom(roomID, userID); err != nil {
+		log.Printf("Error leaving room %s in broker: %v", roomID, err)
+	}
+	log.Printf("User %s left room %s", userID, roomID)
+}
+
+// roomsFor возвращает комнаты, в которых сейчас состоит пользователь
+func (h *Hub) roomsFor(userID string) []string {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	client, ok := h.clients[userID]
+	if !ok {
+		return nil
+	}
+	rooms := make([]string, 0, len(client.rooms))
+	for room := range client.rooms {
+		rooms = append(rooms, room)
+	}
+	return rooms
+}
+
+// peersIn возвращает userID всех участников комнаты
+func (h *Hub) peersIn(room string) []string {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	peers := make([]string, 0, len(h.rooms[room]))
+	for userID := range h.rooms[room] {
+		peers = append(peers, userID)
+	}
+	return peers
+}
+
+// publishControl рассылает служебный кадр (presence/typing) участникам
+// комнаты напрямую через broker, в обход Store - такие события не
+// персистятся и не получают seq.
+func (h *Hub) publishControl(room string, payload []byte) {
+	if err := h.broker.PublishRoom(room, wireEncode(websocket.TextMessage, payload)); err != nil {
+		log.Printf("Error publishing control message to room %s: %v", room, err)
+	}
+}
+
+// publishPresence рассылает presence-событие комнате - используется хабом
+// напрямую при отключении клиента (Client.broadcastPresence используется
+// для join/leave, инициированных самим клиентом).
+func (h *Hub) publishPresence(room, userID, status string) {
+	payload, err := json.Marshal(Message{Type: msgTypePresence, Room: room, Message: status, UserIDs: []string{userID}})
+	if err != nil {
+		log.Printf("Error marshalling presence for room %s: %v", room, err)
+		return
+	}
+	h.publishControl(room, payload)
+}
+
+// routeBinary решает, куда отправить бинарный кадр - та же маршрутизация
+// по Room/UserIDs, что и у текстовых сообщений, но без Store (бинарные
+// кадры не персистятся и не получают seq) и без оборачивания в JSON.
+func (h *Hub) routeBinary(header BinaryHeader, payload []byte) {
+	if header.Room != "" {
+		h.broadcast <- roomMessage{room: header.Room, kind: websocket.BinaryMessage, rawPayload: payload}
+	} else if len(header.UserIDs) > 0 {
+		h.direct <- directMessage{userIDs: header.UserIDs, kind: websocket.BinaryMessage, payload: payload}
+	}
+}
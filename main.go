@@ -1,28 +1,34 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
-	"github.com/gorilla/websocket"
 	"io/ioutil"
 	"log"
 	"net/http"
 	"os"
-	"sync"
+	"os/signal"
+	"strconv"
+	"syscall"
+	"time"
+
+	"github.com/gin-contrib/gzip"
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
-// Структура сообщения
+// Структура сообщения. Type различает обычный broadcast/direct (пусто или
+// "message") и служебные кадры протокола - см. константы msgType* в control.go
 type Message struct {
 	Type    string   `json:"type"`
 	Message string   `json:"message"`
 	Room    string   `json:"room,omitempty"`     // Новый параметр Room, он может быть пустым
 	UserIDs []string `json:"user_ids,omitempty"` // Этот параметр может быть пустым, если Room не пустой
-}
-
-// Структура для хранения WebSocket соединений с привязкой к пользователям
-type Client struct {
-	conn *websocket.Conn
-	id   string
+	Seq     uint64   `json:"seq,omitempty"`      // Порядковый номер в рамках комнаты, проставляется Store
+	Rooms   []string `json:"rooms,omitempty"`    // Список комнат - ответ на list_rooms
+	Code    int      `json:"code,omitempty"`     // Код ошибки - только для type == "error"
 }
 
 type Config struct {
@@ -30,18 +36,29 @@ type Config struct {
 	CertFilePath string `json:"cert_file_path"` // Путь к сертификату
 	KeyFilePath  string `json:"key_file_path"`  // Путь к ключу
 	Port         string `json:"port"`           // Порт для подключения
-}
+	JWTSecret    string `json:"jwt_secret"`      // Секрет HS256 для проверки токенов; пусто - auth отключена
+	Broker       string `json:"broker"`          // "local" (по умолчанию) или "redis"
+	RedisURL     string `json:"redis_url"`       // redis://... , нужен при Broker == "redis"
 
-var rooms = make(map[string][]string)
+	Store                string `json:"store"`                 // "" (без истории), "sqlite" или "bolt"
+	StorePath            string `json:"store_path"`            // путь к файлу БД, нужен при Store != ""
+	HistoryMaxPerRoom    int    `json:"history_max_per_room"`    // 0 - без ограничения
+	HistoryMaxAgeSeconds int    `json:"history_max_age_seconds"` // 0 - без ограничения
 
-var (
-	clients      = make(map[string]*Client) // Хранение пользователей по ID
-	clientsMutex sync.Mutex                 // Мьютекс для синхронизации доступа к клиентам
-	upgrader     = websocket.Upgrader{
-		CheckOrigin: func(r *http.Request) bool { return true },
-	}
+	Compression      bool `json:"compression"`       // включить permessage-deflate
+	CompressionLevel int  `json:"compression_level"` // уровень сжатия, см. flate.NewWriter; 0 - значение по умолчанию gorilla/websocket
+}
+
+const (
+	compactionInterval = 5 * time.Minute
+	shutdownDrainTime  = 10 * time.Second
+	shutdownHTTPTime   = 15 * time.Second
 )
 
+var upgrader = websocket.Upgrader{
+	CheckOrigin: func(r *http.Request) bool { return true },
+}
+
 // Загрузка конфигурации из файла
 func loadConfig() (*Config, error) {
 	file, err := os.Open("config.json")
@@ -60,192 +77,207 @@ func loadConfig() (*Config, error) {
 	return config, nil
 }
 
-func enableCors(w *http.ResponseWriter) {
-	(*w).Header().Set("Access-Control-Allow-Origin", "*")
-}
-
-// Обработка сообщений от клиента через WebSocket
-func handleMessages(conn *websocket.Conn, userID string) {
-	defer conn.Close()
+// Обработчик WebSocket-соединений. Апгрейдит запрос, проверяет токен (если
+// auth включена), регистрирует клиента в хабе и запускает его read/write насосы.
+func handleWebSocket(hub *Hub, store Store, jwtSecret string, compression bool, compressionLevel int) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var claims *Claims
+		if jwtSecret != "" {
+			var err error
+			claims, err = parseToken(extractToken(r), jwtSecret)
+			if err != nil {
+				http.Error(w, "invalid or missing token", http.StatusUnauthorized)
+				return
+			}
+		}
 
-	for {
-		// Чтение сообщения от клиента
-		_, msg, err := conn.ReadMessage()
+		conn, err := upgrader.Upgrade(w, r, nil)
 		if err != nil {
-			log.Printf("Error reading message: %v", err)
-			clientsMutex.Lock()
-			delete(clients, userID)
-			clientsMutex.Unlock()
-			break
+			log.Printf("Error upgrading connection: %v", err)
+			return
 		}
 
-		// Парсинг JSON сообщения
-		var msgObj Message
-		if err := json.Unmarshal(msg, &msgObj); err != nil {
-			log.Printf("Error unmarshalling message: %v", err)
-			continue
+		if compression {
+			conn.EnableWriteCompression(true)
+			if compressionLevel != 0 {
+				conn.SetCompressionLevel(compressionLevel)
+			}
 		}
 
-		// Проверка на заполненность Room и UserIDs
-		if msgObj.Room != "" {
-			// Отправляем сообщение всем пользователям в этой комнате
-			sendToRoom(msgObj)
-		} else if len(msgObj.UserIDs) > 0 {
-			// Если Room пустой, отправляем по UserIDs
-			clientsMutex.Lock()
-			for _, id := range msgObj.UserIDs {
-				if client, ok := clients[id]; ok {
-					err := client.conn.WriteMessage(websocket.TextMessage, msg)
-					if err != nil {
-						log.Printf("Error sending message to client %s: %v", id, err)
-					}
-				}
-			}
-			clientsMutex.Unlock()
+		// user_id берём из токена (sub), если auth включена - иначе из
+		// query-параметра, как раньше
+		userID := r.URL.Query().Get("user_id")
+		if claims != nil {
+			userID = claims.Subject
 		}
-	}
-}
+		roomID := r.URL.Query().Get("room_id")
 
-func sendToRoom(msgObj Message) {
-	clientsMutex.Lock()
-	defer clientsMutex.Unlock()
+		if userID == "" {
+			log.Println("User ID is required")
+			conn.Close()
+			return
+		}
 
-	// Получаем список пользователей в комнате
-	roomID := msgObj.Room
-	usersInRoom, exists := rooms[roomID]
-	if !exists {
-		log.Printf("Room %s does not exist", roomID)
-		return
-	}
+		client := &Client{
+			hub:    hub,
+			conn:   conn,
+			id:     userID,
+			send:   make(chan outboundFrame, sendBufSize),
+			rooms:  make(map[string]bool),
+			claims: claims,
+			closed: make(chan struct{}),
+		}
 
-	// Отправляем сообщение всем пользователям в этой комнате
-	for _, userID := range usersInRoom {
-		if client, ok := clients[userID]; ok {
-			err := client.conn.WriteMessage(websocket.TextMessage, []byte(msgObj.Message))
-			if err != nil {
-				log.Printf("Error sending message to client %s: %v", userID, err)
+		hub.register <- client
+
+		if roomID != "" {
+			if claims != nil && !claims.allowsRoom(roomID) {
+				closeWithCode(client, closeForbidden, "room not allowed by token")
+				// writePump/readPump never start on this path, so they can't
+				// run their deferred conn.Close() - close it ourselves or the
+				// socket leaks.
+				conn.Close()
+				return
+			}
+			client.broadcastPresence(roomID, presenceJoin)
+			hub.joinRoom(userID, roomID)
+
+			if lastSeq, err := strconv.ParseUint(r.URL.Query().Get("last_seq"), 10, 64); err == nil {
+				replayHistory(client, store, roomID, lastSeq)
 			}
 		}
+
+		if claims != nil {
+			go monitorAuth(client, claims)
+		}
+
+		// writePump - единственный писатель в соединение, запускаем отдельно
+		go client.writePump()
+		// readPump блокирует, пока соединение живо
+		client.readPump()
 	}
 }
 
-func joinRoom(userID, roomID string) {
-	clientsMutex.Lock()
-	defer clientsMutex.Unlock()
+// Обработчик POST запросов для отправки сообщений
+func sendMessage(hub *Hub) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var msg Message
+		decoder := json.NewDecoder(r.Body)
+		if err := decoder.Decode(&msg); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
 
-	// Добавляем пользователя в комнату
-	rooms[roomID] = append(rooms[roomID], userID)
-	log.Printf("User %s joined room %s", userID, roomID)
-}
+		// Если user_ids не указаны, отправлять не будем
+		if len(msg.UserIDs) == 0 {
+			http.Error(w, "No user_ids provided", http.StatusBadRequest)
+			return
+		}
 
-// Обработчик WebSocket-соединений
-func handleWebSocket(w http.ResponseWriter, r *http.Request) {
+		messageJSON, err := json.Marshal(msg)
+		if err != nil {
+			log.Printf("Error marshalling message: %v", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
 
-	enableCors(&w)
-	// Преобразование HTTP-соединения в WebSocket
-	conn, err := upgrader.Upgrade(w, r, nil)
-	if err != nil {
-		log.Printf("Error upgrading connection: %v", err)
-		return
-	}
+		hub.direct <- directMessage{userIDs: msg.UserIDs, kind: websocket.TextMessage, payload: messageJSON}
 
-	// Получаем user_id из запроса
-	userID := r.URL.Query().Get("user_id")
-	roomID := r.URL.Query().Get("room_id")
+		w.WriteHeader(http.StatusOK)
+		fmt.Fprintf(w, "Message sent to %d clients", len(msg.UserIDs))
+	}
+}
 
-	if userID == "" {
-		log.Println("User ID is required")
-		conn.Close()
-		return
+// newRouter собирает gin-engine с middleware и маршрутами. /ws и /send
+// остаются на верхнем уровне для обратной совместимости и продублированы
+// под /v1 вместе с новыми /history и /metrics.
+func newRouter(hub *Hub, store Store, config *Config) *gin.Engine {
+	upgrader.EnableCompression = config.Compression
+	wsHandler := handleWebSocket(hub, store, config.JWTSecret, config.Compression, config.CompressionLevel)
+	sendHandler := sendMessage(hub)
+	historyH := historyHandler(store)
+	if config.JWTSecret != "" {
+		sendHandler = tokenMiddleware(config.JWTSecret, true, sendHandler)
+		historyH = tokenMiddleware(config.JWTSecret, false, historyH)
 	}
 
-	// Добавляем клиента
-	clientsMutex.Lock()
-	clients[userID] = &Client{conn: conn, id: userID}
-	clientsMutex.Unlock()
+	router := gin.New()
+	router.Use(gin.Recovery(), requestIDMiddleware, loggingMiddleware, corsMiddleware)
+	router.Use(gzip.Gzip(gzip.DefaultCompression, gzip.WithExcludedPaths([]string{"/ws", "/v1/ws"})))
 
-	log.Printf("User %s connected", userID)
+	router.GET("/metrics", gin.WrapH(promhttp.Handler()))
 
-	if roomID != "" {
-		joinRoom(userID, roomID)
-	}
+	v1 := router.Group("/v1")
+	v1.GET("/ws", gin.WrapF(wsHandler))
+	v1.POST("/send", gin.WrapF(sendHandler))
+	v1.GET("/history", gin.WrapF(historyH))
+
+	router.GET("/ws", gin.WrapF(wsHandler))
+	router.POST("/send", gin.WrapF(sendHandler))
 
-	// Обрабатываем сообщения от клиента
-	handleMessages(conn, userID)
+	return router
 }
 
-// Обработчик POST запросов для отправки сообщений
-func sendMessage(w http.ResponseWriter, r *http.Request) {
-	// Чтение и парсинг POST запроса
-	var msg Message
-	decoder := json.NewDecoder(r.Body)
-	if err := decoder.Decode(&msg); err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
-		return
+func main() {
+	config, err := loadConfig()
+	if err != nil {
+		log.Fatalf("Error loading config: %v", err)
 	}
 
-	// Если user_ids не указаны, отправлять не будем
-	if len(msg.UserIDs) == 0 {
-		http.Error(w, "No user_ids provided", http.StatusBadRequest)
-		return
+	broker, err := newBroker(config)
+	if err != nil {
+		log.Fatalf("Error setting up broker: %v", err)
 	}
 
-	// Отправляем сообщение указанным пользователям
-	clientsMutex.Lock()
-	defer clientsMutex.Unlock()
+	store, err := newStore(config)
+	if err != nil {
+		log.Fatalf("Error setting up store: %v", err)
+	}
+	if compactor, ok := store.(Compactor); ok {
+		go compactionLoop(compactor, config)
+	}
 
-	for _, id := range msg.UserIDs {
-		if client, ok := clients[id]; ok {
-			// Отправляем сообщение
-			messageJSON, err := json.Marshal(msg)
-			if err != nil {
-				log.Printf("Error marshalling message: %v", err)
-				continue
+	hub := newHub(broker, store)
+	go hub.run()
+
+	router := newRouter(hub, store, config)
+	srv := &http.Server{Addr: ":" + config.Port, Handler: router}
+
+	go func() {
+		var serveErr error
+		if config.ServerMode == "https" {
+			if _, err := ioutil.ReadFile(config.CertFilePath); err != nil {
+				log.Fatalf("Error reading cert file: %v", err)
 			}
-			err = client.conn.WriteMessage(websocket.TextMessage, messageJSON)
-			if err != nil {
-				log.Printf("Error sending message to client %s: %v", id, err)
+			if _, err := ioutil.ReadFile(config.KeyFilePath); err != nil {
+				log.Fatalf("Error reading key file: %v", err)
 			}
+
+			log.Printf("Starting HTTPS server on :%s", config.Port)
+			serveErr = srv.ListenAndServeTLS(config.CertFilePath, config.KeyFilePath)
 		} else {
-			log.Printf("Client %s not connected", id)
+			log.Printf("Starting HTTP server on :%s", config.Port)
+			serveErr = srv.ListenAndServe()
 		}
-	}
 
-	// Ответ на POST запрос
-	w.WriteHeader(http.StatusOK)
-	fmt.Fprintf(w, "Message sent to %d clients", len(msg.UserIDs))
-}
+		if serveErr != nil && serveErr != http.ErrServerClosed {
+			log.Fatalf("Error starting server: %v", serveErr)
+		}
+	}()
 
-func main() {
-	config, err := loadConfig()
-	if err != nil {
-		log.Fatalf("Error loading config: %v", err)
-	}
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	<-ctx.Done()
 
-	// Обработчики
-	http.HandleFunc("/ws", handleWebSocket) // WebSocket соединения
-	http.HandleFunc("/send", sendMessage)   // POST запрос для отправки сообщений
-
-	// Запуск сервера
-	port := config.Port
-	if config.ServerMode == "https" {
-		certFile := config.CertFilePath
-		keyFile := config.KeyFilePath
-		if _, err := ioutil.ReadFile(certFile); err != nil {
-			log.Fatalf("Error reading cert file: %v", err)
-		}
-		if _, err := ioutil.ReadFile(keyFile); err != nil {
-			log.Fatalf("Error reading key file: %v", err)
-		}
+	log.Println("Shutting down...")
 
-		log.Printf("Starting HTTPS server on :%s", port)
-		if err := http.ListenAndServeTLS(":"+port, certFile, keyFile, nil); err != nil {
-			log.Fatalf("Error starting HTTPS server: %v", err)
-		}
-	} else {
-		log.Printf("Starting HTTP server on :%s", port)
-		if err := http.ListenAndServe(":"+port, nil); err != nil {
-			log.Fatalf("Error starting HTTP server: %v", err)
-		}
+	// Останавливаем приём новых апгрейдов и дожидаемся активных запросов
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownHTTPTime)
+	defer cancel()
+	if err := srv.Shutdown(shutdownCtx); err != nil {
+		log.Printf("Error during server shutdown: %v", err)
 	}
+
+	// Рассылаем close-фреймы живым websocket-клиентам, дав им время на drain
+	hub.Shutdown(shutdownDrainTime)
 }
@@ -0,0 +1,29 @@
+package main
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	metricConnectedClients = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "ws_connected_clients",
+		Help: "Number of currently connected websocket clients on this node",
+	})
+
+	metricMessagesTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "ws_messages_total",
+		Help: "Number of messages processed, labeled by direction (in/out) and room",
+	}, []string{"direction", "room"})
+
+	metricBroadcastLatency = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name:    "ws_broadcast_latency_seconds",
+		Help:    "Time from a room message entering the hub to it being handed to the broker",
+		Buckets: prometheus.DefBuckets,
+	})
+
+	metricDroppedSlowClients = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "ws_dropped_slow_clients_total",
+		Help: "Number of clients disconnected for having a full send buffer",
+	})
+)
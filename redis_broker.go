@@ -0,0 +1,160 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	roomChannelPrefix = "ws:room:"
+	userChannelPrefix = "ws:user:"
+	membersKeySuffix  = ":members"
+	membershipTTL     = 2 * time.Minute
+	heartbeatInterval = 30 * time.Second
+)
+
+// RedisBroker позволяет нескольким узлам сервера обмениваться сообщениями:
+// публикация на одном узле доходит до клиентов, подключённых к другому,
+// через Redis Pub/Sub. Членство в комнатах хранится в Redis-сетах с TTL,
+// чтобы упавший узел не оставлял "зависших" участников.
+type RedisBroker struct {
+	client *redis.Client
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	mu         sync.Mutex
+	membership map[string]map[string]bool // room -> set of userID joined via this node
+}
+
+func newRedisBroker(redisURL string) (*RedisBroker, error) {
+	opt, err := redis.ParseURL(redisURL)
+	if err != nil {
+		return nil, fmt.Errorf("parsing redis url: %w", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	b := &RedisBroker{
+		client:     redis.NewClient(opt),
+		ctx:        ctx,
+		cancel:     cancel,
+		membership: make(map[string]map[string]bool),
+	}
+
+	if err := b.client.Ping(ctx).Err(); err != nil {
+		cancel()
+		return nil, fmt.Errorf("connecting to redis: %w", err)
+	}
+
+	go b.heartbeatLoop()
+
+	return b, nil
+}
+
+func (b *RedisBroker) PublishRoom(room string, payload []byte) error {
+	return b.client.Publish(b.ctx, roomChannelPrefix+room, payload).Err()
+}
+
+func (b *RedisBroker) PublishUser(userID string, payload []byte) error {
+	return b.client.Publish(b.ctx, userChannelPrefix+userID, payload).Err()
+}
+
+// SubscribeRoom подписывается на все комнатные каналы и вызывает handler
+// для каждого полученного сообщения, извлекая имя комнаты из канала.
+func (b *RedisBroker) SubscribeRoom(handler func(room string, payload []byte)) {
+	b.subscribeChannel(roomChannelPrefix+"*", roomChannelPrefix, handler)
+}
+
+// SubscribeUser подписывается на все личные каналы пользователей
+func (b *RedisBroker) SubscribeUser(handler func(userID string, payload []byte)) {
+	b.subscribeChannel(userChannelPrefix+"*", userChannelPrefix, handler)
+}
+
+func (b *RedisBroker) subscribeChannel(pattern string, prefix string, handler func(target string, payload []byte)) {
+	pubsub := b.client.PSubscribe(b.ctx, pattern)
+	go func() {
+		defer pubsub.Close()
+		ch := pubsub.Channel()
+		for {
+			select {
+			case msg, ok := <-ch:
+				if !ok {
+					return
+				}
+				target := msg.Channel[len(prefix):]
+				handler(target, []byte(msg.Payload))
+			case <-b.ctx.Done():
+				return
+			}
+		}
+	}()
+}
+
+func (b *RedisBroker) JoinRoom(room, userID string) error {
+	key := roomChannelPrefix + room + membersKeySuffix
+	if err := b.client.SAdd(b.ctx, key, userID).Err(); err != nil {
+		return err
+	}
+	if err := b.client.Expire(b.ctx, key, membershipTTL).Err(); err != nil {
+		return err
+	}
+
+	b.mu.Lock()
+	if b.membership[room] == nil {
+		b.membership[room] = make(map[string]bool)
+	}
+	b.membership[room][userID] = true
+	b.mu.Unlock()
+
+	return nil
+}
+
+func (b *RedisBroker) LeaveRoom(room, userID string) error {
+	b.mu.Lock()
+	if members := b.membership[room]; members != nil {
+		delete(members, userID)
+		if len(members) == 0 {
+			delete(b.membership, room)
+		}
+	}
+	b.mu.Unlock()
+
+	return b.client.SRem(b.ctx, roomChannelPrefix+room+membersKeySuffix, userID).Err()
+}
+
+// heartbeatLoop периодически продлевает TTL у ключей членства, за которые
+// отвечает этот узел, чтобы живые комнаты не протухали
+func (b *RedisBroker) heartbeatLoop() {
+	ticker := time.NewTicker(heartbeatInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			b.mu.Lock()
+			rooms := make([]string, 0, len(b.membership))
+			for room := range b.membership {
+				rooms = append(rooms, room)
+			}
+			b.mu.Unlock()
+
+			for _, room := range rooms {
+				key := roomChannelPrefix + room + membersKeySuffix
+				if err := b.client.Expire(b.ctx, key, membershipTTL).Err(); err != nil {
+					log.Printf("Error refreshing membership TTL for room %s: %v", room, err)
+				}
+			}
+		case <-b.ctx.Done():
+			return
+		}
+	}
+}
+
+func (b *RedisBroker) Close() error {
+	b.cancel()
+	return b.client.Close()
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+)
+
+func newTestRedisBroker(t *testing.T) (*RedisBroker, *miniredis.Miniredis) {
+	t.Helper()
+
+	mr := miniredis.RunT(t)
+	broker, err := newRedisBroker("redis://" + mr.Addr())
+	if err != nil {
+		t.Fatalf("newRedisBroker: %v", err)
+	}
+	t.Cleanup(func() { broker.Close() })
+
+	return broker, mr
+}
+
+func TestRedisBrokerPublishRoomDeliversLocally(t *testing.T) {
+	broker, _ := newTestRedisBroker(t)
+
+	received := make(chan []byte, 1)
+	broker.SubscribeRoom(func(room string, payload []byte) {
+		if room == "lobby" {
+			received <- payload
+		}
+	})
+
+	// give the subscription goroutine time to attach before publishing
+	time.Sleep(50 * time.Millisecond)
+
+	if err := broker.PublishRoom("lobby", []byte("hello")); err != nil {
+		t.Fatalf("PublishRoom: %v", err)
+	}
+
+	select {
+	case payload := <-received:
+		if string(payload) != "hello" {
+			t.Fatalf("got payload %q, want %q", payload, "hello")
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("timed out waiting for message")
+	}
+}
+
+func TestRedisBrokerJoinRoomMirrorsMembership(t *testing.T) {
+	broker, mr := newTestRedisBroker(t)
+
+	if err := broker.JoinRoom("lobby", "alice"); err != nil {
+		t.Fatalf("JoinRoom: %v", err)
+	}
+
+	members, err := mr.SMembers(roomChannelPrefix + "lobby" + membersKeySuffix)
+	if err != nil {
+		t.Fatalf("SMembers: %v", err)
+	}
+	if len(members) != 1 || members[0] != "alice" {
+		t.Fatalf("got members %v, want [alice]", members)
+	}
+
+	if err := broker.LeaveRoom("lobby", "alice"); err != nil {
+		t.Fatalf("LeaveRoom: %v", err)
+	}
+
+	members, err = mr.SMembers(roomChannelPrefix + "lobby" + membersKeySuffix)
+	if err != nil && err != miniredis.ErrKeyNotFound {
+		t.Fatalf("SMembers: %v", err)
+	}
+	if len(members) != 0 {
+		t.Fatalf("got members %v, want none after leave", members)
+	}
+}
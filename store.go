@@ -0,0 +1,68 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"time"
+)
+
+// Stored - сообщение комнаты, как оно лежит в Store, с присвоенным seq
+type Stored struct {
+	Seq      uint64    `json:"seq"`
+	Room     string    `json:"room"`
+	Message  Message   `json:"message"`
+	StoredAt time.Time `json:"stored_at"`
+}
+
+// Store хранит историю сообщений комнат для replay при переподключении.
+// Append присваивает монотонно растущий в рамках комнаты seq.
+type Store interface {
+	Append(room string, msg Message) (seq uint64, err error)
+	Since(room string, seq uint64, limit int) ([]Stored, error)
+	Close() error
+}
+
+// Compactor - опциональный интерфейс для Store, поддерживающих retention.
+// Compact удаляет сообщения сверх maxPerRoom на комнату или старше maxAge
+// (0 означает "без ограничения" для соответствующего параметра).
+type Compactor interface {
+	Compact(maxPerRoom int, maxAge time.Duration) error
+}
+
+// noopStore - поведение по умолчанию, когда персистентность выключена:
+// Append не сохраняет ничего и возвращает seq 0, Since всегда пуст.
+type noopStore struct{}
+
+func (noopStore) Append(room string, msg Message) (uint64, error) { return 0, nil }
+func (noopStore) Since(room string, seq uint64, limit int) ([]Stored, error) {
+	return nil, nil
+}
+func (noopStore) Close() error { return nil }
+
+// newStore выбирает реализацию Store по конфигу
+func newStore(cfg *Config) (Store, error) {
+	switch cfg.Store {
+	case "":
+		return noopStore{}, nil
+	case "sqlite":
+		return newSQLiteStore(cfg.StorePath)
+	case "bolt":
+		return newBoltStore(cfg.StorePath)
+	default:
+		return nil, fmt.Errorf("unknown store %q", cfg.Store)
+	}
+}
+
+// compactionLoop периодически применяет retention policy из конфига
+func compactionLoop(compactor Compactor, cfg *Config) {
+	ticker := time.NewTicker(compactionInterval)
+	defer ticker.Stop()
+
+	maxAge := time.Duration(cfg.HistoryMaxAgeSeconds) * time.Second
+
+	for range ticker.C {
+		if err := compactor.Compact(cfg.HistoryMaxPerRoom, maxAge); err != nil {
+			log.Printf("Error compacting history: %v", err)
+		}
+	}
+}
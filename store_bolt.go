@@ -0,0 +1,134 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// boltRecord - то, что реально лежит в бакете комнаты: сообщение + время
+type boltRecord struct {
+	Message   Message   `json:"message"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// BoltStore - альтернатива SQLiteStore на встроенном key-value хранилище.
+// Каждая комната - свой bucket, ключ - seq в big-endian (чтобы сортировка
+// байт ключей совпадала с сортировкой по числу).
+type BoltStore struct {
+	db *bolt.DB
+}
+
+func newBoltStore(path string) (*BoltStore, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: 1 * time.Second})
+	if err != nil {
+		return nil, err
+	}
+	return &BoltStore{db: db}, nil
+}
+
+func seqKey(seq uint64) []byte {
+	key := make([]byte, 8)
+	binary.BigEndian.PutUint64(key, seq)
+	return key
+}
+
+func (s *BoltStore) Append(room string, msg Message) (uint64, error) {
+	var seq uint64
+
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		bucket, err := tx.CreateBucketIfNotExists([]byte(room))
+		if err != nil {
+			return err
+		}
+
+		seq, err = bucket.NextSequence()
+		if err != nil {
+			return err
+		}
+
+		record := boltRecord{Message: msg, CreatedAt: time.Now()}
+		payload, err := json.Marshal(record)
+		if err != nil {
+			return err
+		}
+
+		return bucket.Put(seqKey(seq), payload)
+	})
+
+	return seq, err
+}
+
+func (s *BoltStore) Since(room string, seq uint64, limit int) ([]Stored, error) {
+	var result []Stored
+
+	err := s.db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(room))
+		if bucket == nil {
+			return nil
+		}
+
+		c := bucket.Cursor()
+		for k, v := c.Seek(seqKey(seq + 1)); k != nil && len(result) < limit; k, v = c.Next() {
+			var record boltRecord
+			if err := json.Unmarshal(v, &record); err != nil {
+				return err
+			}
+			result = append(result, Stored{
+				Seq:      binary.BigEndian.Uint64(k),
+				Room:     room,
+				Message:  record.Message,
+				StoredAt: record.CreatedAt,
+			})
+		}
+		return nil
+	})
+
+	return result, err
+}
+
+// Compact удаляет записи старше maxAge и/или сверх maxPerRoom на комнату
+func (s *BoltStore) Compact(maxPerRoom int, maxAge time.Duration) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.ForEach(func(name []byte, bucket *bolt.Bucket) error {
+			cutoff := time.Now().Add(-maxAge)
+
+			if maxAge > 0 {
+				c := bucket.Cursor()
+				for k, v := c.First(); k != nil; k, v = c.Next() {
+					var record boltRecord
+					if err := json.Unmarshal(v, &record); err != nil {
+						return err
+					}
+					if record.CreatedAt.Before(cutoff) {
+						if err := bucket.Delete(k); err != nil {
+							return err
+						}
+					}
+				}
+			}
+
+			if maxPerRoom > 0 {
+				total := bucket.Stats().KeyN
+				if total > maxPerRoom {
+					toDrop := total - maxPerRoom
+					c := bucket.Cursor()
+					for k, _ := c.First(); k != nil && toDrop > 0; k, _ = c.Next() {
+						if err := bucket.Delete(k); err != nil {
+							return err
+						}
+						toDrop--
+					}
+				}
+			}
+
+			return nil
+		})
+	})
+}
+
+func (s *BoltStore) Close() error {
+	return s.db.Close()
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"time"
+
+	_ "modernc.org/sqlite"
+)
+
+// SQLiteStore персистит историю сообщений в файле SQLite. seq присваивается
+// как MAX(seq)+1 в рамках транзакции, так что он монотонно растёт на комнату.
+type SQLiteStore struct {
+	db *sql.DB
+}
+
+func newSQLiteStore(path string) (*SQLiteStore, error) {
+	db, err := sql.Open("sqlite", path)
+	if err != nil {
+		return nil, err
+	}
+
+	const schema = `
+		CREATE TABLE IF NOT EXISTS messages (
+			room       TEXT NOT NULL,
+			seq        INTEGER NOT NULL,
+			payload    BLOB NOT NULL,
+			created_at DATETIME NOT NULL,
+			PRIMARY KEY (room, seq)
+		);
+	`
+	if _, err := db.Exec(schema); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return &SQLiteStore{db: db}, nil
+}
+
+func (s *SQLiteStore) Append(room string, msg Message) (uint64, error) {
+	payload, err := json.Marshal(msg)
+	if err != nil {
+		return 0, err
+	}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	var seq uint64
+	row := tx.QueryRow(`SELECT COALESCE(MAX(seq), 0) + 1 FROM messages WHERE room = ?`, room)
+	if err := row.Scan(&seq); err != nil {
+		return 0, err
+	}
+
+	if _, err := tx.Exec(
+		`INSERT INTO messages (room, seq, payload, created_at) VALUES (?, ?, ?, ?)`,
+		room, seq, payload, time.Now(),
+	); err != nil {
+		return 0, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+
+	return seq, nil
+}
+
+func (s *SQLiteStore) Since(room string, seq uint64, limit int) ([]Stored, error) {
+	rows, err := s.db.Query(
+		`SELECT seq, payload, created_at FROM messages WHERE room = ? AND seq > ? ORDER BY seq ASC LIMIT ?`,
+		room, seq, limit,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var result []Stored
+	for rows.Next() {
+		var (
+			rec      Stored
+			payload  []byte
+			storedAt time.Time
+		)
+		if err := rows.Scan(&rec.Seq, &payload, &storedAt); err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal(payload, &rec.Message); err != nil {
+			return nil, err
+		}
+		rec.Room = room
+		rec.StoredAt = storedAt
+		result = append(result, rec)
+	}
+
+	return result, rows.Err()
+}
+
+// Compact удаляет сообщения сверх maxPerRoom (оставляя самые новые) и/или
+// старше maxAge. 0 отключает соответствующее ограничение.
+func (s *SQLiteStore) Compact(maxPerRoom int, maxAge time.Duration) error {
+	if maxAge > 0 {
+		if _, err := s.db.Exec(`DELETE FROM messages WHERE created_at < ?`, time.Now().Add(-maxAge)); err != nil {
+			return err
+		}
+	}
+
+	if maxPerRoom > 0 {
+		const stmt = `
+			DELETE FROM messages
+			WHERE rowid IN (
+				SELECT rowid FROM (
+					SELECT rowid, ROW_NUMBER() OVER (PARTITION BY room ORDER BY seq DESC) AS rn
+					FROM messages
+				) WHERE rn > ?
+			)
+		`
+		if _, err := s.db.Exec(stmt, maxPerRoom); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (s *SQLiteStore) Close() error {
+	return s.db.Close()
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+// newTestStores возвращает по экземпляру каждого backend'а Store, с очисткой
+// через t.Cleanup - используется, чтобы гонять одни и те же проверки на
+// обеих реализациях.
+func newTestStores(t *testing.T) map[string]Store {
+	t.Helper()
+
+	boltStore, err := newBoltStore(t.TempDir() + "/history.db")
+	if err != nil {
+		t.Fatalf("newBoltStore: %v", err)
+	}
+	t.Cleanup(func() { boltStore.Close() })
+
+	sqliteStore, err := newSQLiteStore(t.TempDir() + "/history.db")
+	if err != nil {
+		t.Fatalf("newSQLiteStore: %v", err)
+	}
+	t.Cleanup(func() { sqliteStore.Close() })
+
+	return map[string]Store{"bolt": boltStore, "sqlite": sqliteStore}
+}
+
+func TestStoreAppendSinceOrdering(t *testing.T) {
+	for name, store := range newTestStores(t) {
+		t.Run(name, func(t *testing.T) {
+			for i := 0; i < 5; i++ {
+				seq, err := store.Append("lobby", Message{Message: fmt.Sprintf("msg-%d", i)})
+				if err != nil {
+					t.Fatalf("Append: %v", err)
+				}
+				if seq != uint64(i+1) {
+					t.Fatalf("got seq %d, want %d", seq, i+1)
+				}
+			}
+
+			got, err := store.Since("lobby", 2, 10)
+			if err != nil {
+				t.Fatalf("Since: %v", err)
+			}
+			if len(got) != 3 {
+				t.Fatalf("got %d messages, want 3", len(got))
+			}
+			for i, rec := range got {
+				wantSeq := uint64(i + 3)
+				wantMsg := fmt.Sprintf("msg-%d", i+2)
+				if rec.Seq != wantSeq || rec.Message.Message != wantMsg {
+					t.Fatalf("got %+v at index %d, want seq %d msg %q", rec, i, wantSeq, wantMsg)
+				}
+			}
+
+			limited, err := store.Since("lobby", 0, 2)
+			if err != nil {
+				t.Fatalf("Since with limit: %v", err)
+			}
+			if len(limited) != 2 || limited[0].Seq != 1 || limited[1].Seq != 2 {
+				t.Fatalf("got %+v, want the first two messages in seq order", limited)
+			}
+		})
+	}
+}
+
+func TestStoreCompactMaxPerRoom(t *testing.T) {
+	for name, store := range newTestStores(t) {
+		t.Run(name, func(t *testing.T) {
+			compactor, ok := store.(Compactor)
+			if !ok {
+				t.Fatalf("%T does not implement Compactor", store)
+			}
+
+			for i := 0; i < 5; i++ {
+				if _, err := store.Append("lobby", Message{Message: fmt.Sprintf("msg-%d", i)}); err != nil {
+					t.Fatalf("Append: %v", err)
+				}
+			}
+
+			if err := compactor.Compact(2, 0); err != nil {
+				t.Fatalf("Compact: %v", err)
+			}
+
+			got, err := store.Since("lobby", 0, 10)
+			if err != nil {
+				t.Fatalf("Since: %v", err)
+			}
+			if len(got) != 2 || got[0].Seq != 4 || got[1].Seq != 5 {
+				t.Fatalf("got %+v, want only the two newest messages (seq 4 and 5) to survive", got)
+			}
+		})
+	}
+}
+
+func TestStoreCompactMaxAge(t *testing.T) {
+	for name, store := range newTestStores(t) {
+		t.Run(name, func(t *testing.T) {
+			compactor, ok := store.(Compactor)
+			if !ok {
+				t.Fatalf("%T does not implement Compactor", store)
+			}
+
+			if _, err := store.Append("lobby", Message{Message: "old"}); err != nil {
+				t.Fatalf("Append: %v", err)
+			}
+			time.Sleep(50 * time.Millisecond)
+			if _, err := store.Append("lobby", Message{Message: "new"}); err != nil {
+				t.Fatalf("Append: %v", err)
+			}
+
+			if err := compactor.Compact(0, 25*time.Millisecond); err != nil {
+				t.Fatalf("Compact: %v", err)
+			}
+
+			got, err := store.Since("lobby", 0, 10)
+			if err != nil {
+				t.Fatalf("Since: %v", err)
+			}
+			if len(got) != 1 || got[0].Message.Message != "new" {
+				t.Fatalf("got %+v, want only the newer message to survive", got)
+			}
+		})
+	}
+}